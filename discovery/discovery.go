@@ -0,0 +1,299 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery resolves exporter targets through pluggable service
+// discovery mechanisms (static lists, a watched file, DNS SRV records,
+// Consul's catalog), so the viewer can be pointed at a service name instead
+// of a hardcoded exporter URL in dynamic environments.
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Target is one resolved, scrapeable exporter instance. Labels carries
+// whatever metadata the discovery mechanism knows about it (Consul tags,
+// the SRV port, ...) so callers can relabel scraped metrics with it.
+type Target struct {
+	Name   string
+	URL    string
+	Labels map[string]string
+}
+
+// TargetProvider resolves the current targets for a named service.
+type TargetProvider interface {
+	Targets(service string) ([]Target, error)
+}
+
+// Registry looks up a TargetProvider by scheme (e.g. "consul", "file") and
+// resolves a (service, instance) pair to a Target.
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]TargetProvider
+}
+
+// NewRegistry returns an empty Registry; use Register to add providers.
+func NewRegistry() *Registry {
+	return &Registry{providers: map[string]TargetProvider{}}
+}
+
+// Register adds a provider under the given scheme, overwriting any
+// provider already registered for it.
+func (r *Registry) Register(scheme string, p TargetProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[scheme] = p
+}
+
+// Resolve finds the named instance of service through the provider
+// registered for scheme.
+func (r *Registry) Resolve(scheme, service, instance string) (Target, error) {
+	r.mu.RLock()
+	p, ok := r.providers[scheme]
+	r.mu.RUnlock()
+	if !ok {
+		return Target{}, fmt.Errorf("discovery: no provider registered for scheme %q", scheme)
+	}
+	targets, err := p.Targets(service)
+	if err != nil {
+		return Target{}, err
+	}
+	for _, t := range targets {
+		if t.Name == instance {
+			return t, nil
+		}
+	}
+	return Target{}, fmt.Errorf("discovery: instance %q not found for service %q via %q", instance, service, scheme)
+}
+
+// StaticProvider serves a fixed, in-memory set of targets per service.
+type StaticProvider struct {
+	targets map[string][]Target
+}
+
+// NewStaticProvider wraps a pre-built service-name-to-targets map.
+func NewStaticProvider(targets map[string][]Target) *StaticProvider {
+	return &StaticProvider{targets: targets}
+}
+
+func (s *StaticProvider) Targets(service string) ([]Target, error) {
+	return s.targets[service], nil
+}
+
+// fileGroup is one entry of a discovery file: a service name plus the
+// targets currently known for it, analogous to a Prometheus file_sd group.
+type fileGroup struct {
+	Service string `json:"service"`
+	Targets []struct {
+		Name   string            `json:"name"`
+		URL    string            `json:"url"`
+		Labels map[string]string `json:"labels"`
+	} `json:"targets"`
+}
+
+// FileProvider serves targets read from a JSON file, reloading whenever the
+// file changes on disk.
+type FileProvider struct {
+	path string
+
+	mu     sync.RWMutex
+	groups map[string][]Target
+}
+
+// NewFileProvider reads path once and then watches it for changes via
+// fsnotify for the lifetime of the process.
+func NewFileProvider(path string) (*FileProvider, error) {
+	fp := &FileProvider{path: path, groups: map[string][]Target{}}
+	if err := fp.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("discovery: creating watcher for %q failed: %s", path, err)
+	}
+	if err := watcher.Add(path); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("discovery: watching %q failed: %s", path, err)
+	}
+	go fp.watch(watcher)
+
+	return fp, nil
+}
+
+func (fp *FileProvider) watch(w *fsnotify.Watcher) {
+	defer w.Close()
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := fp.reload(); err != nil {
+				log.Printf("discovery: reloading %q failed: %s", fp.path, err)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("discovery: watching %q failed: %s", fp.path, err)
+		}
+	}
+}
+
+func (fp *FileProvider) reload() error {
+	data, err := os.ReadFile(fp.path)
+	if err != nil {
+		return fmt.Errorf("discovery: reading %q failed: %s", fp.path, err)
+	}
+	var fileGroups []fileGroup
+	if err := json.Unmarshal(data, &fileGroups); err != nil {
+		return fmt.Errorf("discovery: parsing %q failed: %s", fp.path, err)
+	}
+
+	groups := map[string][]Target{}
+	for _, g := range fileGroups {
+		for _, t := range g.Targets {
+			groups[g.Service] = append(groups[g.Service], Target{Name: t.Name, URL: t.URL, Labels: t.Labels})
+		}
+	}
+
+	fp.mu.Lock()
+	fp.groups = groups
+	fp.mu.Unlock()
+	return nil
+}
+
+func (fp *FileProvider) Targets(service string) ([]Target, error) {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	return fp.groups[service], nil
+}
+
+// DNSProvider resolves targets via DNS SRV lookups, e.g. against a Consul
+// DNS interface or any other SRV-serving resolver.
+type DNSProvider struct {
+	// domain is appended to the service name to build the SRV query name,
+	// e.g. service "node-exporter" with domain "service.consul" looks up
+	// "node-exporter.service.consul".
+	domain string
+}
+
+// NewDNSProvider returns a DNSProvider that looks up "<service>.<domain>"
+// SRV records. domain may be empty to look up the service name verbatim.
+func NewDNSProvider(domain string) *DNSProvider {
+	return &DNSProvider{domain: domain}
+}
+
+func (d *DNSProvider) Targets(service string) ([]Target, error) {
+	name := service
+	if d.domain != "" {
+		name = service + "." + d.domain
+	}
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: SRV lookup for %q failed: %s", name, err)
+	}
+
+	targets := make([]Target, 0, len(addrs))
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		targets = append(targets, Target{
+			Name:   fmt.Sprintf("%s:%d", host, addr.Port),
+			URL:    fmt.Sprintf("http://%s:%d/metrics", host, addr.Port),
+			Labels: map[string]string{"srv_port": fmt.Sprint(addr.Port)},
+		})
+	}
+	return targets, nil
+}
+
+// ConsulProvider resolves targets from Consul's service catalog, tagging
+// each with its Consul node name and tags. It talks to Consul's
+// HTTP catalog API directly with net/http and encoding/json instead of
+// pulling in the consul/api client, matching loadTargetsFile's and
+// loadRulesFile's preference for avoiding heavyweight dependencies in what
+// is otherwise a debug tool.
+type ConsulProvider struct {
+	addr string
+}
+
+// consulDefaultAddr is used when NewConsulProvider is given an empty addr,
+// matching Consul's own default agent HTTP address.
+const consulDefaultAddr = "127.0.0.1:8500"
+
+// NewConsulProvider returns a ConsulProvider that queries the Consul agent
+// at addr (host:port, e.g. "consul.service.consul:8500"); "" uses
+// consulDefaultAddr.
+func NewConsulProvider(addr string) (*ConsulProvider, error) {
+	if addr == "" {
+		addr = consulDefaultAddr
+	}
+	return &ConsulProvider{addr: addr}, nil
+}
+
+// consulServiceEntry mirrors the fields this package needs out of a
+// Consul /v1/catalog/service/<service> response entry.
+type consulServiceEntry struct {
+	Node           string
+	Address        string
+	ServiceAddress string
+	ServicePort    int
+	ServiceTags    []string
+}
+
+func (c *ConsulProvider) Targets(service string) ([]Target, error) {
+	url := fmt.Sprintf("http://%s/v1/catalog/service/%s", c.addr, service)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: Consul catalog lookup for %q failed: %s", service, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: Consul catalog lookup for %q returned HTTP status %s", service, resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("discovery: parsing Consul catalog response for %q failed: %s", service, err)
+	}
+
+	targets := make([]Target, 0, len(entries))
+	for _, e := range entries {
+		addr := e.ServiceAddress
+		if addr == "" {
+			addr = e.Address
+		}
+		labels := map[string]string{"consul_node": e.Node}
+		if len(e.ServiceTags) > 0 {
+			labels["consul_tags"] = "," + strings.Join(e.ServiceTags, ",") + ","
+		}
+		targets = append(targets, Target{
+			Name:   e.Node,
+			URL:    fmt.Sprintf("http://%s:%d/metrics", addr, e.ServicePort),
+			Labels: labels,
+		})
+	}
+	return targets, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryResolve(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("static", NewStaticProvider(map[string][]Target{
+		"node-exporter": {{Name: "instance-1", URL: "http://10.0.0.1:9100/metrics"}},
+	}))
+
+	target, err := reg.Resolve("static", "node-exporter", "instance-1")
+	if err != nil {
+		t.Fatalf("Resolve: %s", err)
+	}
+	if target.URL != "http://10.0.0.1:9100/metrics" {
+		t.Errorf("Resolve URL = %q, want %q", target.URL, "http://10.0.0.1:9100/metrics")
+	}
+
+	if _, err := reg.Resolve("static", "node-exporter", "no-such-instance"); err == nil {
+		t.Error("Resolve with unknown instance should have failed")
+	}
+	if _, err := reg.Resolve("no-such-scheme", "node-exporter", "instance-1"); err == nil {
+		t.Error("Resolve with unregistered scheme should have failed")
+	}
+}
+
+// TestConsulProviderTargets exercises ConsulProvider against a fake HTTP
+// server standing in for Consul's catalog API, so the JSON decoding of
+// /v1/catalog/service/<service> is covered without a real Consul agent.
+func TestConsulProviderTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/catalog/service/node-exporter" {
+			http.NotFound(w, r)
+			return
+		}
+		// Tags deliberately contain characters ("-", ".") that are illegal
+		// in Prometheus label *names*, to guard against regressing to the
+		// old one-label-per-tag scheme.
+		w.Write([]byte(`[{
+			"Node": "node-1",
+			"Address": "10.0.0.1",
+			"ServiceAddress": "",
+			"ServicePort": 9100,
+			"ServiceTags": ["canary-v2", "us-east-1", "v1.2.3"]
+		}]`))
+	}))
+	defer srv.Close()
+
+	provider, err := NewConsulProvider(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewConsulProvider: %s", err)
+	}
+	targets, err := provider.Targets("node-exporter")
+	if err != nil {
+		t.Fatalf("Targets: %s", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("got %d targets, want 1", len(targets))
+	}
+	got := targets[0]
+	if got.Name != "node-1" || got.URL != "http://10.0.0.1:9100/metrics" {
+		t.Errorf("Targets[0] = %+v, want Name=node-1 URL=http://10.0.0.1:9100/metrics", got)
+	}
+	if want := ",canary-v2,us-east-1,v1.2.3,"; got.Labels["consul_tags"] != want {
+		t.Errorf("Targets[0].Labels[consul_tags] = %q, want %q", got.Labels["consul_tags"], want)
+	}
+}
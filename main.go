@@ -14,6 +14,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -22,34 +23,120 @@ import (
 	"log"
 	"mime"
 	"net/http"
+	"os"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/matttproud/golang_protobuf_extensions/ext"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/text"
 
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/discordianfish/prometheus-exporter-viewer/discovery"
+	"github.com/discordianfish/prometheus-exporter-viewer/rules"
+)
+
+// Self-instrumentation: counters and histograms describing the viewer's own
+// behavior, exposed at /-/metrics.
+var (
+	requestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "exporter_viewer_requests_total",
+		Help: "Total number of HTTP requests handled by the viewer.",
+	})
+	scrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "exporter_viewer_scrape_duration_seconds",
+		Help: "Duration of scraping a target.",
+	}, []string{"target"})
+	scrapeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "exporter_viewer_scrape_failures_total",
+		Help: "Total number of failed scrapes, by target and error class.",
+	}, []string{"target", "error"})
+	responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exporter_viewer_scrape_response_size_bytes",
+		Help:    "Size of the upstream scrape response body.",
+		Buckets: prometheus.ExponentialBuckets(128, 4, 8),
+	}, []string{"target"})
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "exporter_viewer_parse_errors_total",
+		Help: "Total number of errors parsing a scraped response, by format.",
+	}, []string{"format"})
 )
 
+func init() {
+	prometheus.MustRegister(requestsTotal, scrapeDuration, scrapeFailures, responseSize, parseErrors)
+}
+
 const (
-	acceptHeader  = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+	// maxConcurrentScrapes bounds the worker pool used to fan out across
+	// targets so a large target list can't open unbounded connections.
+	maxConcurrentScrapes = 10
+	// cacheTTL should stay at or below the Rickshaw poll interval in
+	// graphTemplate so repeated browser polls don't cause repeated scrapes.
+	cacheTTL = 3 * time.Second
+
+	acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+
+	// Content types the viewer itself can negotiate and emit, so Prometheus
+	// (or another client that sends a proper Accept header) can scrape the
+	// viewer as an aggregating pass-through rather than only browsers
+	// fetching application/json.
+	contentTypeJSON        = "application/json"
+	contentTypeText        = "text/plain; version=0.0.4"
+	contentTypeProto       = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0"
+
 	graphTemplate = `<html>
 	<head>
 		<script src="//cdnjs.cloudflare.com/ajax/libs/d3/3.4.11/d3.min.js"></script>
 		<script src="//cdnjs.cloudflare.com/ajax/libs/rickshaw/1.4.6/rickshaw.min.js"></script>
+		<style>
+			.panel { border-bottom: 1px solid #ccc; padding: 8px 0; }
+			.panel h3 { margin: 0; }
+			.panel .help { color: #666; font-size: 0.9em; margin: 2px 0; }
+			.panel .toggles label { margin-right: 8px; font-size: 0.85em; }
+			.panel .chart { margin-top: 4px; }
+			.alert { background: #fdd; border: 1px solid #c00; padding: 4px; margin-bottom: 2px; }
+		</style>
 	</head>
 	<body>
-		<div id="chart"></div>
+		<div id="alerts"></div>
+		<input id="filter" type="text" placeholder="Filter metric families..." />
+		<div id="panels"></div>
 		<script>
 			var interval = 3000;
 			var maxPoints = 100;
-			var graph = new Rickshaw.Graph({
-				element: document.querySelector("#chart"), 
-				series: new Rickshaw.Series.FixedDuration([{ name: 'one' }], undefined, {
-					timeInterval: interval,
-					maxDataPoints: maxPoints,
-					timeBase: new Date().getTime() / 1000
-				})
-			})
+			var tick = 0;
+			var filter = "";
+			var panels = {};
+
+			function updateAlerts() {
+				var req = new XMLHttpRequest();
+				req.onreadystatechange = function() {
+					if (req.readyState !== 4 || req.status !== 200) return;
+					var alerts = JSON.parse(req.responseText);
+					var div = document.getElementById('alerts');
+					if (alerts.length === 0) {
+						div.textContent = '';
+						return;
+					}
+					div.innerHTML = alerts.filter(function(a) { return a.active; }).map(function(a) {
+						return '<div class="alert">' + a.rule + ' ' + seriesKey(a.labels) + ' = ' + a.value + '</div>';
+					}).join('');
+				};
+				req.open('GET', '/alerts', true);
+				req.send(null);
+			}
+			window.setInterval(updateAlerts, interval);
+			updateAlerts();
+
+			document.getElementById('filter').addEventListener('input', function(e) {
+				filter = e.target.value;
+			});
 
 			var httpRequest;
 			if (window.XMLHttpRequest) { // Mozilla, Safari, ...
@@ -57,39 +144,126 @@ const (
 			} else if (window.ActiveXObject) { // IE 8 and older
 		  		httpRequest = new ActiveXObject("Microsoft.XMLHTTP");
 			}
-		
+
 			var ticker = window.setInterval(function() {
-				httpRequest.onreadystatechange = updateGraph
+				httpRequest.onreadystatechange = update
 				httpRequest.open('GET', window.location, true);
 				httpRequest.setRequestHeader("Accept", "application/json")
 				httpRequest.send(null);
 			}, interval)
-		    
-			function updateGraph() {
-				if (httpRequest.readyState === 4) {
-					graph.series.addData(transform(httpRequest.responseText))
-					graph.render();
-		      		}
-		    	}
-
-			function transform(data) {
-				json = JSON.parse(data);
+
+			function ensurePanel(name, help, type) {
+				if (panels[name]) return panels[name];
+				var el = document.createElement('div');
+				el.className = 'panel';
+				el.innerHTML = '<h3>' + name + ' <small>' + type + '</small></h3>' +
+					'<p class="help"></p>' +
+					'<div class="toggles"></div>' +
+					'<div class="chart"></div>';
+				el.querySelector('.help').textContent = help || '';
+				document.getElementById('panels').appendChild(el);
+				panels[name] = { el: el, history: {}, toggles: {}, type: type };
+				return panels[name];
+			}
+
+			function seriesKey(labels, extra) {
+				var parts = [];
+				for (var k in labels) parts.push(k + '=' + labels[k]);
+				if (extra) parts.push(extra);
+				return parts.length ? parts.join(',') : '(no labels)';
+			}
+
+			// leValue turns a bucket's "le" string into a number buckets can
+			// be sorted by, handling the "+Inf"/"-Inf" bounds Go's histogram
+			// buckets use that parseFloat can't.
+			function leValue(le) {
+				if (le === '+Inf') return Infinity;
+				if (le === '-Inf') return -Infinity;
+				return parseFloat(le);
+			}
+
+			function recordPoint(panel, key, value) {
+				if (!panel.history[key]) {
+					panel.history[key] = [];
+					panel.toggles[key] = true;
+				}
+				var points = panel.history[key];
+				points.push({ x: tick, y: value });
+				if (points.length > maxPoints) points.shift();
+			}
+
+			function renderPanel(panel) {
+				var chartDiv = panel.el.querySelector('.chart');
+				var togglesDiv = panel.el.querySelector('.toggles');
+				chartDiv.innerHTML = '';
+				togglesDiv.innerHTML = '';
+
+				var keys = Object.keys(panel.history);
 				var palette = new Rickshaw.Color.Palette();
-				
-				var series = {}
-				for (var mi in json) {
-					if (json[mi]['type'] == "SUMMARY") {
-						continue
+				var seriesDefs = [];
+				keys.forEach(function(key) {
+					var color = palette.color();
+					if (panel.toggles[key]) {
+						seriesDefs.push({ name: key, data: panel.history[key], color: color });
 					}
-					for (var di in json[mi]['metrics']) {
-						for (var key in json[mi]['metrics'][di]['labels']) {
-							var name = json[mi]['name'] + '{' + key + '=' + json[mi]['metrics'][di]['labels'][key] + '}'
-							series[name] = parseFloat(json[mi]['metrics'][di]['value'])
+					var label = document.createElement('label');
+					var cb = document.createElement('input');
+					cb.type = 'checkbox';
+					cb.checked = !!panel.toggles[key];
+					cb.addEventListener('change', function() {
+						panel.toggles[key] = cb.checked;
+						renderPanel(panel);
+					});
+					label.appendChild(cb);
+					label.appendChild(document.createTextNode(key));
+					togglesDiv.appendChild(label);
+				});
+				if (seriesDefs.length === 0) return;
+
+				// Histograms render as a bucket-stacked area chart (a
+				// lightweight stand-in for a heatmap); everything else,
+				// including per-quantile summary lines, as overlaid lines.
+				var graph = new Rickshaw.Graph({
+					element: chartDiv,
+					width: 700,
+					height: 150,
+					renderer: panel.type === 'HISTOGRAM' ? 'stack' : 'line',
+					series: seriesDefs
+				});
+				graph.render();
+			}
+
+			function update() {
+				if (httpRequest.readyState !== 4) return;
+				tick++;
+				var families = JSON.parse(httpRequest.responseText);
+				families.forEach(function(mf) {
+					var panel = ensurePanel(mf.name, mf.help, mf.type);
+					panel.el.style.display = (!filter || mf.name.indexOf(filter) !== -1) ? '' : 'none';
+
+					(mf.metrics || []).forEach(function(m) {
+						if (mf.type === 'SUMMARY') {
+							for (var q in (m.quantiles || {})) {
+								recordPoint(panel, seriesKey(m.labels, 'quantile=' + q), parseFloat(m.quantiles[q]));
+							}
+						} else if (mf.type === 'HISTOGRAM') {
+							// m.buckets holds cumulative counts ("<= le"),
+							// but the stacked-area renderer needs each
+							// bucket's own share, so convert to per-bucket
+							// deltas in ascending le order before recording.
+							var les = Object.keys(m.buckets || {}).sort(function(a, b) { return leValue(a) - leValue(b); });
+							var prevCount = 0;
+							les.forEach(function(le) {
+								var cumulative = parseFloat(m.buckets[le]);
+								recordPoint(panel, seriesKey(m.labels, 'le=' + le), cumulative - prevCount);
+								prevCount = cumulative;
+							});
+						} else {
+							recordPoint(panel, seriesKey(m.labels), parseFloat(m.value));
 						}
-					}
-				}
-				console.log(series)
-				return series
+					});
+					renderPanel(panel);
+				});
 			}
 		</script>
 	</body>
@@ -99,9 +273,355 @@ const (
 var (
 	addr = flag.String("addr", ":8000", "Address to listen on")
 
+	targetsFlag = flag.String("targets", "", "Comma-separated list of exporter targets to aggregate, as job=url or url pairs")
+	targetsFile = flag.String("targets.file", "", "File listing exporter targets to aggregate, one 'job url' pair per line")
+
+	rulesFile     = flag.String("rules.file", "", "File listing alerting rules, one 'name<TAB>expr[<TAB>webhook]' triple per line")
+	rulesInterval = flag.Duration("rules.interval", 15*time.Second, "How often to evaluate alerting rules")
+
+	discoveryFile       = flag.String("discovery.file", "", "JSON file of discovered targets to serve at /file/<service>/<instance>, watched for changes")
+	discoveryDNSDomain  = flag.String("discovery.dns-domain", "", "Domain SRV-queried as <service>.<domain> to serve at /dns/<service>/<instance>")
+	discoveryConsulAddr = flag.String("discovery.consul-addr", "", "Consul agent address (host:port) to serve targets at /consul/<service>/<instance> (empty disables Consul discovery)")
+
 	templates = template.Must(template.New("graph").Parse(graphTemplate))
+
+	// configuredTargets holds the targets from -targets/-targets.file, if
+	// any, enabling the aggregating "/" endpoint alongside the original
+	// ad-hoc single-exporter path.
+	configuredTargets []target
+
+	// ruleEngine is non-nil when -rules.file configured at least one rule.
+	ruleEngine *rules.Engine
+
+	// discoveryRegistry is non-nil once at least one -discovery.* flag
+	// configures a provider, enabling /<scheme>/<service>/<instance> routing.
+	discoveryRegistry *discovery.Registry
 )
 
+// target is a single named exporter to scrape. Job mirrors Prometheus's
+// scrape_config job name and is attached to every metric as a label.
+type target struct {
+	Job string
+	URL string
+}
+
+// parseTargets parses the -targets flag value, a comma-separated list of
+// either "job=url" or bare "url" entries. A bare URL is its own job name.
+func parseTargets(raw string) []target {
+	var targets []target
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			targets = append(targets, target{Job: parts[0], URL: parts[1]})
+		} else {
+			targets = append(targets, target{Job: entry, URL: entry})
+		}
+	}
+	return targets
+}
+
+// loadTargetsFile reads a target list file, similar in spirit to a
+// Prometheus file_sd file but kept to a single "job url" pair per line to
+// avoid pulling in a YAML dependency for what is otherwise a debug tool.
+// Blank lines and lines starting with # are ignored.
+func loadTargetsFile(path string) ([]target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []target
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid target line %q: expected 'job url'", line)
+		}
+		targets = append(targets, target{Job: fields[0], URL: fields[1]})
+	}
+	return targets, scanner.Err()
+}
+
+// loadRulesFile reads an alerting rules file, one "name<TAB>expr[<TAB>
+// webhook]" triple per line, mirroring the plain-text style of
+// loadTargetsFile rather than pulling in a YAML dependency. Blank lines and
+// lines starting with # are ignored.
+func loadRulesFile(path string) ([]rules.Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []rules.Rule
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid rule on line %d of %s: expected 'name<TAB>expr[<TAB>webhook]'", lineNo, path)
+		}
+		var webhook string
+		if len(fields) == 3 {
+			webhook = strings.TrimSpace(fields[2])
+		}
+		rule, err := rules.NewRule(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]), webhook)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule on line %d of %s: %s", lineNo, path, err)
+		}
+		result = append(result, rule)
+	}
+	return result, scanner.Err()
+}
+
+// scrapeForRules is the rules.Scraper backing ruleEngine: rules evaluate
+// against the same aggregated, instance/job-labelled view as the "/"
+// endpoint, since ad-hoc single-exporter requests aren't persistent enough
+// to alert on.
+func scrapeForRules() ([]*dto.MetricFamily, error) {
+	if len(configuredTargets) == 0 {
+		return nil, fmt.Errorf("rules: no -targets/-targets.file configured")
+	}
+	return aggregateTargetsDTO(configuredTargets), nil
+}
+
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts := []*rules.Alert{}
+	if ruleEngine != nil {
+		alerts = append(alerts, ruleEngine.Alerts()...)
+	}
+	if err := json.NewEncoder(w).Encode(alerts); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// scrapeCache is a short-lived cache of scraped metric families, keyed by
+// target URL plus the Accept header used to fetch them. It exists so that
+// several browsers (or several panels in the same page) polling at the
+// Rickshaw interval don't each trigger their own scrape of the exporter.
+type scrapeCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	expires  time.Time
+	families []*dto.MetricFamily
+}
+
+func newScrapeCache() *scrapeCache {
+	c := &scrapeCache{entries: map[string]cacheEntry{}}
+	go c.evictExpired()
+	return c
+}
+
+func (c *scrapeCache) get(key string) ([]*dto.MetricFamily, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.families, true
+}
+
+func (c *scrapeCache) set(key string, families []*dto.MetricFamily) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{expires: time.Now().Add(cacheTTL), families: families}
+}
+
+// evictExpired periodically drops expired entries so that the ad-hoc
+// exporter path - whose cache key is an arbitrary URL taken from the
+// request - can't grow c.entries without bound; get already treats an
+// expired entry as a miss, this just reclaims the memory.
+func (c *scrapeCache) evictExpired() {
+	for range time.Tick(cacheTTL) {
+		now := time.Now()
+		c.mu.Lock()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+var cache = newScrapeCache()
+
+// adhocMetricTarget is the "target" label self-instrumentation metrics use
+// for scrapes of the legacy ad-hoc URL path, instead of the scraped URL
+// itself: that URL comes straight from the request path, so labelling by it
+// would let a client blow up scrapeDuration/scrapeFailures/responseSize
+// cardinality with arbitrary strings.
+const adhocMetricTarget = "adhoc"
+
+// scrapeCached fetches the metric families for a target, serving them from
+// cache when a fresh-enough copy is available. metricTarget is the bounded
+// identifier self-instrumentation metrics label the scrape with; it must
+// come from a finite set (a configured job name, a discovered
+// "service/instance" pair, or adhocMetricTarget), never the exporter URL itself.
+func scrapeCached(exporterURL, metricTarget string) ([]*dto.MetricFamily, error) {
+	key := exporterURL + "\x00" + acceptHeader
+	if families, ok := cache.get(key); ok {
+		return families, nil
+	}
+
+	families, err := fetchMetricFamilies(exporterURL, metricTarget)
+	if err != nil {
+		return nil, err
+	}
+	cache.set(key, families)
+	return families, nil
+}
+
+// withExtraLabels returns a metric family carrying the same samples as mf
+// plus extra merged into every metric's labels. It never mutates mf or its
+// metrics in place, since both may be shared with scrapeCache entries that
+// outlive a single request.
+func withExtraLabels(mf *dto.MetricFamily, extra map[string]string) *dto.MetricFamily {
+	if len(extra) == 0 {
+		return mf
+	}
+	cp := &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: make([]*dto.Metric, len(mf.Metric))}
+	for i, m := range mf.Metric {
+		labels := make([]*dto.LabelPair, len(m.Label), len(m.Label)+len(extra))
+		copy(labels, m.Label)
+		for k, v := range extra {
+			k, v := k, v
+			labels = append(labels, &dto.LabelPair{Name: &k, Value: &v})
+		}
+		mcp := *m
+		mcp.Label = labels
+		cp.Metric[i] = &mcp
+	}
+	return cp
+}
+
+// aggregateTargetsDTO concurrently scrapes every target through a bounded
+// worker pool, tags each metric with instance/job labels, and merges metric
+// families that share a name across targets.
+func aggregateTargetsDTO(targets []target) []*dto.MetricFamily {
+	sem := make(chan struct{}, maxConcurrentScrapes)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	merged := map[string]*dto.MetricFamily{}
+
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			families, err := scrapeCached(t.URL, t.Job)
+			if err != nil {
+				log.Printf("scraping target %q (job %q) failed: %s", t.URL, t.Job, err)
+				return
+			}
+
+			extraLabels := map[string]string{"job": t.Job, "instance": t.URL}
+			for _, mf := range families {
+				mf := withExtraLabels(mf, extraLabels)
+
+				mu.Lock()
+				if existing, ok := merged[mf.GetName()]; ok {
+					existing.Metric = append(existing.Metric, mf.Metric...)
+				} else {
+					merged[mf.GetName()] = mf
+				}
+				mu.Unlock()
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	result := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		result = append(result, mf)
+	}
+	return result
+}
+
+// collectDTOFamilies resolves a request to its metric families: the
+// aggregated, instance/job-labelled view across configuredTargets, a target
+// resolved through discoveryRegistry, or a single ad-hoc exporter named in
+// the URL path.
+func collectDTOFamilies(r *http.Request) ([]*dto.MetricFamily, error) {
+	if len(r.URL.Path) < 2 {
+		if len(configuredTargets) == 0 {
+			return nil, fmt.Errorf("expect exporter url in path")
+		}
+		return aggregateTargetsDTO(configuredTargets), nil
+	}
+
+	if t, extraLabels, ok := resolveDiscoveryTarget(r.URL.Path); ok {
+		families, err := scrapeCached(t.URL, extraLabels["job"]+"/"+extraLabels["instance"])
+		if err != nil {
+			return nil, err
+		}
+		result := make([]*dto.MetricFamily, len(families))
+		for i, mf := range families {
+			result[i] = withExtraLabels(mf, extraLabels)
+		}
+		return result, nil
+	}
+
+	exporterUrl := fmt.Sprintf("http://%s", r.URL.Path[1:])
+	return scrapeCached(exporterUrl, adhocMetricTarget)
+}
+
+// registerDiscoveryProvider lazily creates discoveryRegistry on first use
+// and registers provider under scheme.
+func registerDiscoveryProvider(scheme string, provider discovery.TargetProvider) {
+	if discoveryRegistry == nil {
+		discoveryRegistry = discovery.NewRegistry()
+	}
+	discoveryRegistry.Register(scheme, provider)
+}
+
+// resolveDiscoveryTarget interprets a "/<scheme>/<service>/<instance>" path
+// (e.g. "/consul/node-exporter/instance-42") through discoveryRegistry,
+// returning the resolved target along with the relabeling to attach to its
+// metrics. ok is false when discovery isn't configured, the path doesn't
+// match that shape, or the registry can't resolve it, so the caller falls
+// back to the legacy ad-hoc URL path.
+func resolveDiscoveryTarget(path string) (discovery.Target, map[string]string, bool) {
+	if discoveryRegistry == nil {
+		return discovery.Target{}, nil, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) != 3 {
+		return discovery.Target{}, nil, false
+	}
+	scheme, service, instance := parts[0], parts[1], parts[2]
+
+	t, err := discoveryRegistry.Resolve(scheme, service, instance)
+	if err != nil {
+		return discovery.Target{}, nil, false
+	}
+
+	labels := map[string]string{"job": service, "instance": t.Name}
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+	return t, labels, true
+}
+
 type metricFamily struct {
 	Name    string        `json:"name"`
 	Help    string        `json:"help"`
@@ -122,6 +642,17 @@ type summary struct {
 	Sum       string            `json:"sum"`
 }
 
+// histogram carries cumulative bucket counts keyed by their "le" (less than
+// or equal) upper bound, same shape as how Prometheus exposes them.
+type histogram struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Buckets map[string]string `json:"buckets,omitempty"`
+	Count   string            `json:"count"`
+	Sum     string            `json:"sum"`
+}
+
+// newMetricFamily converts a scraped dto.MetricFamily into our JSON-shaped
+// representation.
 func newMetricFamily(dtoMF *dto.MetricFamily) *metricFamily {
 	mf := &metricFamily{
 		Name:    dtoMF.GetName(),
@@ -129,18 +660,26 @@ func newMetricFamily(dtoMF *dto.MetricFamily) *metricFamily {
 		Type:    dtoMF.GetType().String(),
 		Metrics: make([]interface{}, len(dtoMF.Metric)),
 	}
-	isSummary := dtoMF.GetType() == dto.MetricType_SUMMARY
 	for i, m := range dtoMF.Metric {
-		if isSummary {
+		labels := makeLabels(m)
+		switch dtoMF.GetType() {
+		case dto.MetricType_SUMMARY:
 			mf.Metrics[i] = summary{
-				Labels:    makeLabels(m),
+				Labels:    labels,
 				Quantiles: makeQuantiles(m),
 				Count:     fmt.Sprint(m.GetSummary().GetSampleCount()),
 				Sum:       fmt.Sprint(m.GetSummary().GetSampleSum()),
 			}
-		} else {
+		case dto.MetricType_HISTOGRAM:
+			mf.Metrics[i] = histogram{
+				Labels:  labels,
+				Buckets: makeBuckets(m),
+				Count:   fmt.Sprint(m.GetHistogram().GetSampleCount()),
+				Sum:     fmt.Sprint(m.GetHistogram().GetSampleSum()),
+			}
+		default:
 			mf.Metrics[i] = metric{
-				Labels: makeLabels(m),
+				Labels: labels,
 				Value:  fmt.Sprint(getValue(m)),
 			}
 		}
@@ -177,64 +716,288 @@ func makeQuantiles(m *dto.Metric) map[string]string {
 	return result
 }
 
-func fetchMetricFamilies(url string, ch chan<- *dto.MetricFamily) {
-	defer close(ch)
+func makeBuckets(m *dto.Metric) map[string]string {
+	result := map[string]string{}
+	for _, b := range m.GetHistogram().Bucket {
+		result[fmt.Sprint(b.GetUpperBound())] = fmt.Sprint(b.GetCumulativeCount())
+	}
+	return result
+}
+
+// countingReader tracks how many bytes have been read through it, so the
+// upstream response size can be observed without buffering the whole body.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fetchMetricFamilies scrapes a single exporter URL. Failures are returned
+// rather than fatal so that one flaky exporter can't take down the whole
+// process; every failure also increments scrapeFailures so it's visible on
+// /-/metrics. metricTarget, not url, is what self-instrumentation metrics
+// are labelled with: url can be an arbitrary attacker-supplied string (the
+// legacy ad-hoc path takes it straight from the request), and labelling by
+// it would let a client grow scrapeDuration/scrapeFailures/responseSize
+// without bound.
+func fetchMetricFamilies(url, metricTarget string) ([]*dto.MetricFamily, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Fatalf("creating GET request for URL %q failed: %s", url, err)
+		scrapeFailures.WithLabelValues(metricTarget, "request").Inc()
+		return nil, fmt.Errorf("creating GET request for URL %q failed: %s", url, err)
 	}
 	req.Header.Add("Accept", acceptHeader)
+
+	start := time.Now()
 	resp, err := http.DefaultClient.Do(req)
+	scrapeDuration.WithLabelValues(metricTarget).Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Fatalf("executing GET request for URL %q failed: %s", url, err)
+		scrapeFailures.WithLabelValues(metricTarget, "request").Inc()
+		return nil, fmt.Errorf("executing GET request for URL %q failed: %s", url, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("GET request for URL %q returned HTTP status %s", url, resp.Status)
+		scrapeFailures.WithLabelValues(metricTarget, "status").Inc()
+		return nil, fmt.Errorf("GET request for URL %q returned HTTP status %s", url, resp.Status)
 	}
 
+	body := &countingReader{Reader: resp.Body}
+
+	var metricFamilies []*dto.MetricFamily
 	mediatype, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err == nil && mediatype == "application/vnd.google.protobuf" &&
 		params["encoding"] == "delimited" &&
 		params["proto"] == "io.prometheus.client.MetricFamily" {
 		for {
 			mf := &dto.MetricFamily{}
-			if _, err = ext.ReadDelimited(resp.Body, mf); err != nil {
+			if _, err = ext.ReadDelimited(body, mf); err != nil {
 				if err == io.EOF {
 					break
 				}
-				log.Fatalln("reading metric family protocol buffer failed:", err)
+				parseErrors.WithLabelValues("protobuf").Inc()
+				scrapeFailures.WithLabelValues(metricTarget, "parse").Inc()
+				return nil, fmt.Errorf("reading metric family protocol buffer from %q failed: %s", url, err)
 			}
-			ch <- mf
+			metricFamilies = append(metricFamilies, mf)
 		}
 	} else {
 		// We could do further content-type checks here, but the
 		// fallback for now will anyway be the text format
 		// version 0.0.4, so just go for it and see if it works.
 		var parser text.Parser
-		metricFamilies, err := parser.TextToMetricFamilies(resp.Body)
+		parsed, err := parser.TextToMetricFamilies(body)
 		if err != nil {
-			log.Fatalln("reading text format failed:", err)
+			parseErrors.WithLabelValues("text").Inc()
+			scrapeFailures.WithLabelValues(metricTarget, "parse").Inc()
+			return nil, fmt.Errorf("reading text format from %q failed: %s", url, err)
 		}
-		for _, mf := range metricFamilies {
-			ch <- mf
+		for _, mf := range parsed {
+			metricFamilies = append(metricFamilies, mf)
 		}
 	}
+
+	responseSize.WithLabelValues(metricTarget).Observe(float64(body.n))
+	return metricFamilies, nil
 }
 
-func handleJson(w http.ResponseWriter, r *http.Request) {
-	mfChan := make(chan *dto.MetricFamily, 1024)
-	if len(r.URL.Path) < 2 {
-		http.Error(w, "expect exporter url in path", http.StatusBadGateway)
-		return
+// acceptEntry is one media-range from a parsed Accept header.
+type acceptEntry struct {
+	mediaType string
+	params    map[string]string
+	q         float64
+}
+
+// parseAcceptHeader parses an Accept header into its media-ranges, sorted
+// by descending q value, à la goautoneg.
+func parseAcceptHeader(header string) []acceptEntry {
+	var entries []acceptEntry
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.TrimSpace(fields[0])
+		if mediaType == "" {
+			continue
+		}
+		entry := acceptEntry{mediaType: mediaType, params: map[string]string{}, q: 1.0}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key, value := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			if key == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					entry.q = q
+				}
+				continue
+			}
+			entry.params[key] = value
+		}
+		entries = append(entries, entry)
 	}
-	exporterUrl := fmt.Sprintf("http://%s", r.URL.Path[1:])
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	return entries
+}
 
-	go fetchMetricFamilies(exporterUrl, mfChan)
+// negotiableFormats maps each format this handler can emit to the media
+// type and parameters an Accept entry must match to select it.
+var negotiableFormats = []struct {
+	mediaType   string
+	params      map[string]string
+	contentType string
+}{
+	{"application/vnd.google.protobuf", map[string]string{"encoding": "delimited", "proto": "io.prometheus.client.MetricFamily"}, contentTypeProto},
+	{"application/openmetrics-text", nil, contentTypeOpenMetrics},
+	{"text/plain", nil, contentTypeText},
+	{"application/json", nil, contentTypeJSON},
+}
 
-	result := []*metricFamily{}
-	for mf := range mfChan {
-		result = append(result, newMetricFamily(mf))
+// negotiateFormat picks the best of negotiableFormats for the given Accept
+// header, returning "" if none matches (the caller then falls back to the
+// HTML graph view, matching what a plain browser GET expects).
+func negotiateFormat(header string) string {
+	for _, entry := range parseAcceptHeader(header) {
+		for _, f := range negotiableFormats {
+			if entry.mediaType != f.mediaType {
+				continue
+			}
+			matched := true
+			for k, v := range f.params {
+				if entry.params[k] != v {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				return f.contentType
+			}
+		}
+	}
+	return ""
+}
+
+// writeOpenMetricsFamily renders a metric family as OpenMetrics text. It
+// covers the subset of the format the viewer needs to round-trip what it
+// scrapes: HELP/TYPE comments and per-sample lines with merged labels. The
+// "# EOF" marker terminates the whole exposition, not a single family, so
+// callers write it once after the last family (see handleExpfmt).
+func writeOpenMetricsFamily(w io.Writer, mf *dto.MetricFamily) error {
+	name := mf.GetName()
+	if help := mf.GetHelp(); help != "" {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, help); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, openMetricsType(mf.GetType())); err != nil {
+		return err
+	}
+	for _, m := range mf.Metric {
+		if err := writeOpenMetricsSample(w, name, mf.GetType(), m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeOpenMetricsSample(w io.Writer, name string, t dto.MetricType, m *dto.Metric) error {
+	labels := makeLabels(m)
+	switch t {
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		for _, q := range s.Quantile {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, "quantile", fmt.Sprint(q.GetQuantile())), fmt.Sprint(q.GetValue())); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels), fmt.Sprint(s.GetSampleSum())); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s_count%s %s\n", name, formatLabels(labels), fmt.Sprint(s.GetSampleCount()))
+		return err
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		for _, b := range h.Bucket {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %s\n", name, formatLabels(labels, "le", fmt.Sprint(b.GetUpperBound())), fmt.Sprint(b.GetCumulativeCount())); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels), fmt.Sprint(h.GetSampleSum())); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s_count%s %s\n", name, formatLabels(labels), fmt.Sprint(h.GetSampleCount()))
+		return err
+	default:
+		_, err := fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), fmt.Sprint(getValue(m)))
+		return err
+	}
+}
+
+// openMetricsType maps a dto.MetricType to the lowercase "# TYPE" keyword
+// OpenMetrics expects.
+func openMetricsType(t dto.MetricType) string {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return "counter"
+	case dto.MetricType_GAUGE:
+		return "gauge"
+	case dto.MetricType_SUMMARY:
+		return "summary"
+	case dto.MetricType_HISTOGRAM:
+		return "histogram"
+	default:
+		return "unknown"
+	}
+}
+
+// formatLabels renders a label set (plus an optional extra key/value pair,
+// e.g. "le" or "quantile") as a "{k="v",...}" braces string, or "" if empty.
+func formatLabels(labels map[string]string, extra ...string) string {
+	if len(extra) == 2 {
+		merged := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			merged[k] = v
+		}
+		merged[extra[0]] = extra[1]
+		labels = merged
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(labels[k])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escapeLabelValue escapes a label value the way the text-based Prometheus
+// exposition formats require: backslashes and quotes are backslash-escaped,
+// and newlines become a literal "\n" so the sample stays on one line.
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return v
+}
+
+func handleJson(w http.ResponseWriter, r *http.Request) {
+	families, err := collectDTOFamilies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	result := make([]*metricFamily, 0, len(families))
+	for _, dtoMF := range families {
+		result = append(result, newMetricFamily(dtoMF))
 	}
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(result); err != nil {
@@ -242,19 +1005,96 @@ func handleJson(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleExpfmt re-exposes the scraped families in one of the Prometheus
+// exposition formats, turning the viewer into a pass-through/aggregating
+// proxy that Prometheus itself can scrape.
+func handleExpfmt(w http.ResponseWriter, r *http.Request, format string) {
+	families, err := collectDTOFamilies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", format)
+	for _, mf := range families {
+		var err error
+		switch format {
+		case contentTypeProto:
+			_, err = ext.WriteDelimited(w, mf)
+		case contentTypeOpenMetrics:
+			err = writeOpenMetricsFamily(w, mf)
+		default: // contentTypeText
+			_, err = text.MetricFamilyToText(w, mf)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+	if format == contentTypeOpenMetrics {
+		if _, err := fmt.Fprint(w, "# EOF\n"); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	log.Println("<", r.URL)
-	accept := r.Header.Get("Accept")
-	if accept == "application/json" {
+	requestsTotal.Inc()
+	format := negotiateFormat(r.Header.Get("Accept"))
+	switch format {
+	case contentTypeJSON:
 		handleJson(w, r)
-		return
+	case contentTypeText, contentTypeProto, contentTypeOpenMetrics:
+		handleExpfmt(w, r, format)
+	default:
+		templates.Execute(w, nil)
 	}
-	templates.Execute(w, nil)
 }
 
 func main() {
 	flag.Parse()
+
+	if *targetsFlag != "" {
+		configuredTargets = append(configuredTargets, parseTargets(*targetsFlag)...)
+	}
+	if *targetsFile != "" {
+		fileTargets, err := loadTargetsFile(*targetsFile)
+		if err != nil {
+			log.Fatalf("loading -targets.file %q failed: %s", *targetsFile, err)
+		}
+		configuredTargets = append(configuredTargets, fileTargets...)
+	}
+
+	if *rulesFile != "" {
+		ruleDefs, err := loadRulesFile(*rulesFile)
+		if err != nil {
+			log.Fatalf("loading -rules.file %q failed: %s", *rulesFile, err)
+		}
+		ruleEngine = rules.NewEngine(scrapeForRules, ruleDefs, 120)
+		go ruleEngine.Run(*rulesInterval, make(chan struct{}))
+	}
+
+	if *discoveryFile != "" {
+		provider, err := discovery.NewFileProvider(*discoveryFile)
+		if err != nil {
+			log.Fatalf("setting up -discovery.file %q failed: %s", *discoveryFile, err)
+		}
+		registerDiscoveryProvider("file", provider)
+	}
+	if *discoveryDNSDomain != "" {
+		registerDiscoveryProvider("dns", discovery.NewDNSProvider(*discoveryDNSDomain))
+	}
+	if *discoveryConsulAddr != "" {
+		provider, err := discovery.NewConsulProvider(*discoveryConsulAddr)
+		if err != nil {
+			log.Fatalf("setting up -discovery.consul-addr %q failed: %s", *discoveryConsulAddr, err)
+		}
+		registerDiscoveryProvider("consul", provider)
+	}
+
 	http.HandleFunc("/", handleRequest)
+	http.HandleFunc("/alerts", handleAlerts)
+	http.Handle("/-/metrics", prometheus.Handler())
 	runtime.GOMAXPROCS(2) // Why?
 
 	log.Fatal(http.ListenAndServe(*addr, nil))
@@ -0,0 +1,78 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func family(name string) *dto.MetricFamily {
+	counter := dto.MetricType_COUNTER
+	value := 1.0
+	return &dto.MetricFamily{
+		Name: &name,
+		Type: &counter,
+		Metric: []*dto.Metric{
+			{Counter: &dto.Counter{Value: &value}},
+		},
+	}
+}
+
+// TestWriteOpenMetricsFamilyNoEOF guards against the "# EOF" marker leaking
+// into a single family's output: OpenMetrics terminates the whole
+// exposition, not each family, so emitting it here would produce a
+// multi-family document with "# EOF" in the middle, which breaks any
+// OpenMetrics parser.
+func TestWriteOpenMetricsFamilyNoEOF(t *testing.T) {
+	var buf bytes.Buffer
+	for _, name := range []string{"foo", "bar"} {
+		if err := writeOpenMetricsFamily(&buf, family(name)); err != nil {
+			t.Fatalf("writeOpenMetricsFamily(%q): %s", name, err)
+		}
+	}
+	if strings.Contains(buf.String(), "# EOF") {
+		t.Errorf("writeOpenMetricsFamily emitted \"# EOF\", expected callers to add it once for the whole exposition:\n%s", buf.String())
+	}
+}
+
+func TestFormatLabelsEscapesSpecialChars(t *testing.T) {
+	got := formatLabels(map[string]string{"path": `C:\tmp\"quoted"` + "\nrest"})
+	want := `{path="C:\\tmp\\\"quoted\"\nrest"}`
+	if got != want {
+		t.Errorf("formatLabels escaping = %q, want %q", got, want)
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		header string
+		want   string
+	}{
+		{"application/openmetrics-text", contentTypeOpenMetrics},
+		{"application/json", contentTypeJSON},
+		{"text/plain", contentTypeText},
+		{`application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited`, contentTypeProto},
+		{"text/html", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := negotiateFormat(c.header); got != c.want {
+			t.Errorf("negotiateFormat(%q) = %q, want %q", c.header, got, c.want)
+		}
+	}
+}
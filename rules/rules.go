@@ -0,0 +1,441 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rules evaluates a small, PromQL-lite subset of expressions
+// against periodically scraped snapshots, firing webhook alerts when they
+// match. It exists for environments where running full Prometheus purely
+// to get basic alerting on a handful of exporters is overkill.
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sample is a single labelled value taken from a snapshot.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Snapshot is one scrape's worth of samples, keyed by metric name.
+type Snapshot struct {
+	Time    time.Time
+	Samples map[string][]Sample
+}
+
+// NewSnapshot builds a Snapshot out of scraped metric families.
+func NewSnapshot(mfs []*dto.MetricFamily) Snapshot {
+	samples := map[string][]Sample{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			samples[mf.GetName()] = append(samples[mf.GetName()], Sample{
+				Labels: makeLabels(m),
+				Value:  value(m),
+			})
+		}
+	}
+	return Snapshot{Time: time.Now(), Samples: samples}
+}
+
+func makeLabels(m *dto.Metric) map[string]string {
+	result := map[string]string{}
+	for _, lp := range m.Label {
+		result[lp.GetName()] = lp.GetValue()
+	}
+	return result
+}
+
+func value(m *dto.Metric) float64 {
+	if m.Gauge != nil {
+		return m.GetGauge().GetValue()
+	}
+	if m.Counter != nil {
+		return m.GetCounter().GetValue()
+	}
+	if m.Untyped != nil {
+		return m.GetUntyped().GetValue()
+	}
+	return 0.
+}
+
+// Result is one label set's outcome of evaluating an Expr against the
+// current snapshot.
+type Result struct {
+	Labels map[string]string
+	Value  float64
+	Firing bool
+}
+
+// Expr is a parsed rule expression. The supported grammar is intentionally
+// small: `metric{labels} OP threshold` and `rate(metric{labels}[window]) OP
+// threshold`, where OP is one of the usual comparison operators.
+type Expr struct {
+	raw       string
+	metric    string
+	matchers  map[string]string
+	isRate    bool
+	window    time.Duration
+	op        string
+	threshold float64
+}
+
+var (
+	comparisonRe = regexp.MustCompile(`^(.+?)\s*(>=|<=|==|!=|>|<)\s*(-?[0-9]+(?:\.[0-9]+)?)\s*$`)
+	rateRe       = regexp.MustCompile(`^rate\((.+)\[(\d+[smh])\]\)$`)
+	selectorRe   = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(.*)\})?$`)
+	matcherRe    = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"([^"]*)"`)
+
+	comparators = map[string]func(a, b float64) bool{
+		">":  func(a, b float64) bool { return a > b },
+		"<":  func(a, b float64) bool { return a < b },
+		">=": func(a, b float64) bool { return a >= b },
+		"<=": func(a, b float64) bool { return a <= b },
+		"==": func(a, b float64) bool { return a == b },
+		"!=": func(a, b float64) bool { return a != b },
+	}
+)
+
+// ParseExpr parses a rule expression. See Expr for the supported grammar.
+func ParseExpr(expr string) (*Expr, error) {
+	cm := comparisonRe.FindStringSubmatch(strings.TrimSpace(expr))
+	if cm == nil {
+		return nil, fmt.Errorf("rules: unsupported expression %q, expected 'selector OP threshold'", expr)
+	}
+	lhs, op, thresholdStr := strings.TrimSpace(cm[1]), cm[2], cm[3]
+	threshold, err := strconv.ParseFloat(thresholdStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("rules: invalid threshold in %q: %s", expr, err)
+	}
+
+	selector := lhs
+	var isRate bool
+	var window time.Duration
+	if rm := rateRe.FindStringSubmatch(lhs); rm != nil {
+		isRate = true
+		selector = rm[1]
+		window, err = time.ParseDuration(rm[2])
+		if err != nil {
+			return nil, fmt.Errorf("rules: invalid rate window in %q: %s", expr, err)
+		}
+	}
+
+	sm := selectorRe.FindStringSubmatch(strings.TrimSpace(selector))
+	if sm == nil {
+		return nil, fmt.Errorf("rules: unsupported selector %q in %q", selector, expr)
+	}
+	matchers := map[string]string{}
+	for _, mm := range matcherRe.FindAllStringSubmatch(sm[3], -1) {
+		matchers[mm[1]] = mm[2]
+	}
+
+	return &Expr{
+		raw:       expr,
+		metric:    sm[1],
+		matchers:  matchers,
+		isRate:    isRate,
+		window:    window,
+		op:        op,
+		threshold: threshold,
+	}, nil
+}
+
+// Eval evaluates the expression against the most recent snapshot in
+// history, using earlier snapshots to compute a rate() window if needed.
+func (e *Expr) Eval(history []Snapshot) []Result {
+	if len(history) == 0 {
+		return nil
+	}
+	latest := history[len(history)-1]
+
+	var results []Result
+	for _, s := range latest.Samples[e.metric] {
+		if !matchLabels(s.Labels, e.matchers) {
+			continue
+		}
+		v := s.Value
+		if e.isRate {
+			baseline, ok := findBaseline(history, e.metric, s.Labels, latest.Time.Add(-e.window))
+			if !ok {
+				continue
+			}
+			elapsed := latest.Time.Sub(baseline.Time).Seconds()
+			if elapsed <= 0 {
+				continue
+			}
+			baseVal, ok := sampleValue(baseline, e.metric, s.Labels)
+			if !ok {
+				continue
+			}
+			v = (s.Value - baseVal) / elapsed
+		}
+		results = append(results, Result{Labels: s.Labels, Value: v, Firing: comparators[e.op](v, e.threshold)})
+	}
+	return results
+}
+
+func matchLabels(labels, matchers map[string]string) bool {
+	for k, v := range matchers {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// findBaseline returns the oldest snapshot at or after cutoff that still
+// has a sample for metric/labels, used as the start of a rate() window.
+func findBaseline(history []Snapshot, metric string, labels map[string]string, cutoff time.Time) (Snapshot, bool) {
+	for _, snap := range history {
+		if snap.Time.Before(cutoff) {
+			continue
+		}
+		if _, ok := sampleValue(snap, metric, labels); ok {
+			return snap, true
+		}
+	}
+	return Snapshot{}, false
+}
+
+func sampleValue(snap Snapshot, metric string, labels map[string]string) (float64, bool) {
+	for _, s := range snap.Samples[metric] {
+		if labelsEqual(s.Labels, labels) {
+			return s.Value, true
+		}
+	}
+	return 0, false
+}
+
+// Rule pairs a named expression with the webhook to notify when it fires
+// or clears.
+type Rule struct {
+	Name       string
+	Expr       string
+	WebhookURL string
+
+	expr *Expr
+}
+
+// NewRule parses expr and returns a ready-to-evaluate Rule.
+func NewRule(name, expr, webhookURL string) (Rule, error) {
+	parsed, err := ParseExpr(expr)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{Name: name, Expr: expr, WebhookURL: webhookURL, expr: parsed}, nil
+}
+
+// Alert is the current state of one rule/label-set combination.
+type Alert struct {
+	Rule   string            `json:"rule"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+	Active bool              `json:"active"`
+	Since  time.Time         `json:"since"`
+}
+
+// Scraper returns the metric families to evaluate rules against. It's
+// supplied by the caller so this package stays independent of how targets
+// are configured or fetched.
+type Scraper func() ([]*dto.MetricFamily, error)
+
+// Engine periodically scrapes via Scraper, keeps a ring buffer of
+// snapshots, evaluates Rules against it, and posts webhook alerts on state
+// transitions.
+type Engine struct {
+	mu           sync.Mutex
+	rules        []Rule
+	history      []Snapshot
+	maxSnapshots int
+	alerts       map[string]*Alert
+
+	scrape Scraper
+	client *http.Client
+}
+
+// NewEngine creates an Engine that retains at most maxSnapshots snapshots.
+func NewEngine(scrape Scraper, rules []Rule, maxSnapshots int) *Engine {
+	return &Engine{
+		scrape:       scrape,
+		rules:        rules,
+		maxSnapshots: maxSnapshots,
+		alerts:       map[string]*Alert{},
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run scrapes and evaluates on every tick of interval until stop is closed.
+func (e *Engine) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.tick()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (e *Engine) tick() {
+	mfs, err := e.scrape()
+	if err != nil {
+		log.Println("rules: scrape failed:", err)
+		return
+	}
+	snap := NewSnapshot(mfs)
+
+	e.mu.Lock()
+	e.history = append(e.history, snap)
+	if len(e.history) > e.maxSnapshots {
+		e.history = e.history[len(e.history)-e.maxSnapshots:]
+	}
+	history := append([]Snapshot(nil), e.history...)
+	e.mu.Unlock()
+
+	for _, rule := range e.rules {
+		e.evalRule(rule, history)
+	}
+}
+
+type transition struct {
+	alert  *Alert
+	firing bool
+}
+
+func (e *Engine) evalRule(rule Rule, history []Snapshot) {
+	results := rule.expr.Eval(history)
+
+	var transitions []transition
+	e.mu.Lock()
+	for _, res := range results {
+		key := alertKey(rule.Name, res.Labels)
+		alert, exists := e.alerts[key]
+		if !exists {
+			alert = &Alert{Rule: rule.Name, Labels: res.Labels}
+			e.alerts[key] = alert
+		}
+		wasActive := alert.Active
+		alert.Active = res.Firing
+		alert.Value = res.Value
+		switch {
+		case res.Firing && !wasActive:
+			alert.Since = time.Now()
+			transitions = append(transitions, transition{alert, true})
+		case !res.Firing && wasActive:
+			transitions = append(transitions, transition{alert, false})
+		}
+	}
+	e.mu.Unlock()
+
+	for _, t := range transitions {
+		e.notify(rule, t.alert, t.firing)
+	}
+}
+
+func alertKey(ruleName string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(ruleName)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%s", k, labels[k])
+	}
+	return b.String()
+}
+
+type webhookPayload struct {
+	Rule   string            `json:"rule"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+	Status string            `json:"status"`
+	Since  time.Time         `json:"since"`
+}
+
+// notify posts a webhook for an alert state transition. The POST itself
+// happens on its own goroutine so a slow or hanging endpoint (the client
+// still enforces a 10s timeout) can't stall evalRule from notifying the
+// rest of this tick's rules or delay the next scrape-and-evaluate cycle.
+// The payload is built here, synchronously, from a copy of the fields it
+// needs rather than the live *Alert, since that Alert can be mutated by
+// the next tick as soon as this one returns.
+func (e *Engine) notify(rule Rule, alert *Alert, firing bool) {
+	if rule.WebhookURL == "" {
+		return
+	}
+	status := "resolved"
+	if firing {
+		status = "firing"
+	}
+	payload := webhookPayload{
+		Rule:   rule.Name,
+		Labels: alert.Labels,
+		Value:  alert.Value,
+		Status: status,
+		Since:  alert.Since,
+	}
+	go e.postWebhook(rule.Name, rule.WebhookURL, payload)
+}
+
+func (e *Engine) postWebhook(ruleName, webhookURL string, payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("rules: marshaling webhook payload failed:", err)
+		return
+	}
+	resp, err := e.client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("rules: posting webhook for", ruleName, "failed:", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Alerts returns a snapshot of the current alert state.
+func (e *Engine) Alerts() []*Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]*Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		cp := *a
+		result = append(result, &cp)
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseExprSelector(t *testing.T) {
+	e, err := ParseExpr(`up{job="node-exporter"} == 0`)
+	if err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	if e.metric != "up" || e.op != "==" || e.threshold != 0 {
+		t.Errorf("ParseExpr = %+v, want metric=up op=== threshold=0", e)
+	}
+	if e.matchers["job"] != "node-exporter" {
+		t.Errorf("ParseExpr matchers = %+v, want job=node-exporter", e.matchers)
+	}
+	if e.isRate {
+		t.Error("ParseExpr isRate = true, want false for a plain selector")
+	}
+}
+
+func TestParseExprRate(t *testing.T) {
+	e, err := ParseExpr(`rate(http_requests_total[5m]) > 100`)
+	if err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	if !e.isRate || e.window != 5*time.Minute || e.metric != "http_requests_total" {
+		t.Errorf("ParseExpr = %+v, want isRate=true window=5m metric=http_requests_total", e)
+	}
+}
+
+func TestParseExprInvalid(t *testing.T) {
+	if _, err := ParseExpr("not an expression"); err == nil {
+		t.Error("ParseExpr with no comparison should have failed")
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	e, err := ParseExpr(`up{job="node-exporter"} == 0`)
+	if err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	history := []Snapshot{{
+		Time: time.Now(),
+		Samples: map[string][]Sample{
+			"up": {
+				{Labels: map[string]string{"job": "node-exporter"}, Value: 0},
+				{Labels: map[string]string{"job": "other"}, Value: 0},
+			},
+		},
+	}}
+	results := e.Eval(history)
+	if len(results) != 1 || !results[0].Firing {
+		t.Errorf("Eval = %+v, want one firing result matching job=node-exporter", results)
+	}
+}
+
+// TestEngineNotifyDoesNotBlock guards against notify stalling rule
+// evaluation on a slow webhook: it should return well before the webhook
+// endpoint responds, posting in the background instead.
+func TestEngineNotifyDoesNotBlock(t *testing.T) {
+	posted := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		posted <- struct{}{}
+	}))
+	defer srv.Close()
+
+	engine := NewEngine(nil, nil, 1)
+	rule := Rule{Name: "test", WebhookURL: srv.URL}
+	alert := &Alert{Rule: "test", Labels: map[string]string{"job": "x"}, Since: time.Now()}
+
+	start := time.Now()
+	engine.notify(rule, alert, true)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("notify took %s, want it to return before the webhook responds", elapsed)
+	}
+
+	select {
+	case <-posted:
+	case <-time.After(time.Second):
+		t.Error("webhook was never posted")
+	}
+}